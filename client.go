@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// A Client exchanges DNS messages with a single server over UDP or TCP.
+type Client struct {
+	Net     string        // "tcp" or "udp", defaults to "udp"
+	Timeout time.Duration // read/write deadline applied to the connection, zero means none
+
+	// TsigSecret maps a TSIG key name to its base64 encoded secret. Set it
+	// together with SetTsig to have Exchange sign outgoing queries and
+	// verify incoming responses automatically.
+	TsigSecret TsigSecret
+
+	tsigKeyname string
+	tsigAlgo    string
+	tsigFudge   uint16
+}
+
+// SetTsig configures c to sign every outgoing query with the key
+// keyname (algorithm algo, clock skew fudge seconds) and to verify the
+// TSIG on every response against that same key. The secret for keyname
+// must already be present in c.TsigSecret.
+func (c *Client) SetTsig(keyname, algo string, fudge uint16) {
+	c.tsigKeyname = keyname
+	c.tsigAlgo = algo
+	c.tsigFudge = fudge
+}
+
+// isStream reports whether network carries DNS messages prefixed with a
+// 2-byte length, as RFC 1035 section 4.2.2 requires over TCP. AXFR and
+// IXFR are TCP-only, so Exchange must frame them this way to interop
+// with a real server.
+func isStream(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// writeStream writes out to conn preceded by its 2-byte big endian length.
+func writeStream(conn net.Conn, out []byte) error {
+	lenbuf := []byte{byte(len(out) >> 8), byte(len(out))}
+	if _, err := conn.Write(lenbuf); err != nil {
+		return err
+	}
+	_, err := conn.Write(out)
+	return err
+}
+
+// readStream reads a single 2-byte length prefixed DNS message from conn.
+func readStream(conn net.Conn) ([]byte, error) {
+	lenbuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenbuf); err != nil {
+		return nil, err
+	}
+	in := make([]byte, int(lenbuf[0])<<8|int(lenbuf[1]))
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// Exchange sends m to addr and returns the reply. If SetTsig has been
+// called, m is signed before it is sent and the reply's TSIG is verified
+// before it is returned; a verification failure is surfaced as the
+// returned error instead of being silently ignored. Over TCP, messages
+// are framed with the 2-byte length prefix isStream describes; over UDP
+// they are sent and received as single datagrams.
+func (c *Client) Exchange(m *Msg, addr string) (*Msg, error) {
+	if c.tsigKeyname != "" {
+		if err := tsigSign(m, c.TsigSecret, c.tsigKeyname, c.tsigAlgo, c.tsigFudge); err != nil {
+			return nil, err
+		}
+	}
+
+	network := c.Net
+	if network == "" {
+		network = "udp"
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if c.Timeout != 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	out, ok := m.Pack()
+	if !ok {
+		return nil, ErrTsigFormat
+	}
+	var in []byte
+	if isStream(network) {
+		if err := writeStream(conn, out); err != nil {
+			return nil, err
+		}
+		in, err = readStream(conn)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(out); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		in = buf[:n]
+	}
+
+	r := new(Msg)
+	if ok := r.Unpack(in); !ok {
+		return nil, ErrTsigFormat
+	}
+
+	if c.tsigKeyname != "" {
+		if err := tsigCheck(r, c.TsigSecret, c.tsigKeyname, c.tsigAlgo); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,83 @@
+package dns
+
+import "net"
+
+// A Handler answers a single DNS query.
+type Handler func(m *Msg) *Msg
+
+// A Server answers DNS queries received on a UDP socket.
+type Server struct {
+	Addr    string // address to listen on, e.g. ":53"
+	Net     string // "udp", defaults to "udp"
+	Handler Handler
+
+	// TsigSecret maps a TSIG key name to its base64 encoded secret. Set
+	// it together with SetTsig to have ListenAndServe verify the TSIG on
+	// every incoming query and sign every reply with that same key.
+	TsigSecret TsigSecret
+
+	tsigKeyname string
+	tsigAlgo    string
+	tsigFudge   uint16
+}
+
+// SetTsig configures s to require and verify a TSIG signed with the key
+// keyname (algorithm algo, clock skew fudge seconds) on every incoming
+// query, and to sign every reply with that same key. The secret for
+// keyname must already be present in s.TsigSecret.
+func (s *Server) SetTsig(keyname, algo string, fudge uint16) {
+	s.tsigKeyname = keyname
+	s.tsigAlgo = algo
+	s.tsigFudge = fudge
+}
+
+// ListenAndServe listens on s.Addr and answers queries with s.Handler
+// until an error occurs. Incoming queries are verified against
+// s.TsigSecret (if SetTsig has been called) before being handed to the
+// handler, and replies are signed with the same key before being sent.
+func (s *Server) ListenAndServe() error {
+	network := s.Net
+	if network == "" {
+		network = "udp"
+	}
+	conn, err := net.ListenPacket(network, s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		m := new(Msg)
+		if ok := m.Unpack(buf[:n]); !ok {
+			continue
+		}
+
+		if s.tsigKeyname != "" {
+			if err := tsigCheck(m, s.TsigSecret, s.tsigKeyname, s.tsigAlgo); err != nil {
+				continue
+			}
+		}
+
+		reply := s.Handler(m)
+		if reply == nil {
+			continue
+		}
+		if s.tsigKeyname != "" {
+			if err := tsigSign(reply, s.TsigSecret, s.tsigKeyname, s.tsigAlgo, s.tsigFudge); err != nil {
+				continue
+			}
+		}
+
+		out, ok := reply.Pack()
+		if !ok {
+			continue
+		}
+		conn.WriteTo(out, addr)
+	}
+}
@@ -4,18 +4,73 @@ package dns
 // RFC 2845 and RFC 4635
 import (
 	"io"
-	"fmt"
+	"hash"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 )
 
-// Need to lookup the actual codes
+// HMAC algorithm names, as used in the TSIG Algorithm field. These are the
+// canonical, lowercase, fully qualified forms required by RFC 4635 section 2
+// for interoperability with BIND and Knot.
 const (
-	HmacMD5    = "HMAC-MD5.SIG-ALG.REG.INT"
-	HmacSHA1   = "hmac-sha1"
-	HmacSHA256 = "hmac-sha256"
+	HmacMD5    = "hmac-md5.sig-alg.reg.int."
+	HmacSHA1   = "hmac-sha1."
+	HmacSHA224 = "hmac-sha224."
+	HmacSHA256 = "hmac-sha256."
+	HmacSHA384 = "hmac-sha384."
+	HmacSHA512 = "hmac-sha512."
+)
+
+// HmacHashes maps a TSIG algorithm name to the hash.Hash constructor used to
+// key the HMAC. Callers can register additional algorithms by adding to
+// this map before calling Generate or Verify.
+var HmacHashes = map[string]func() hash.Hash{
+	HmacMD5:    md5.New,
+	HmacSHA1:   sha1.New,
+	HmacSHA224: sha256.New224,
+	HmacSHA256: sha256.New,
+	HmacSHA384: sha512.New384,
+	HmacSHA512: sha512.New,
+}
+
+// TSIG error codes, see RFC 2845 section 2.3 and RFC 4635 section 3. These
+// are the values carried in the Error field of the TSIG RR, distinct from
+// the normal message RCODE.
+const (
+	TsigErrorNoError  = 0
+	TsigErrorBadSig   = 16
+	TsigErrorBadKey   = 17
+	TsigErrorBadTime  = 18
+	TsigErrorBadTrunc = 22
+)
+
+// TsigError is returned by Generate and Verify when a TSIG operation fails.
+// Code holds the RFC 2845/4635 error value that should be written into the
+// Error field of a TSIG RR sent back to the peer.
+type TsigError struct {
+	Code uint16
+	err  string
+}
+
+func (e *TsigError) Error() string { return e.err }
+
+// Errors returned by Generate and Verify.
+var (
+	ErrTsigAlg      = &TsigError{TsigErrorBadKey, "dns: unknown TSIG algorithm"}
+	ErrTsigBadKey   = &TsigError{TsigErrorBadKey, "dns: bad TSIG key"}
+	ErrTsigBadSig   = &TsigError{TsigErrorBadSig, "dns: bad TSIG signature"}
+	ErrTsigBadTime  = &TsigError{TsigErrorBadTime, "dns: bad TSIG time"}
+	ErrTsigBadTrunc = &TsigError{TsigErrorBadTrunc, "dns: bad TSIG truncation"}
+	ErrTsigFormat   = &TsigError{TsigErrorBadKey, "dns: bad TSIG format"}
+	ErrTsigNoTsig   = &TsigError{TsigErrorBadKey, "dns: no TSIG set in message"}
 )
 
 type RR_TSIG struct {
@@ -69,58 +124,122 @@ type tsigWireFmt struct {
 // to include the MAC and MACSize. Note the the msg Id must
 // be set, otherwise the MAC is not correct.
 // The string 'secret' must be encoded in base64
-func (rr *RR_TSIG) Generate(msg *Msg, secret string) bool {
+func (rr *RR_TSIG) Generate(msg *Msg, secret string) error {
 	rawsecret := unpackBase64([]byte(secret))
-	buf, ok := tsigToBuf(rr, msg)
+	buf, err := tsigToBuf(rr, msg)
+	if err != nil {
+		return err
+	}
+	newHmac, ok := HmacHashes[strings.ToLower(rr.Algorithm)]
 	if !ok {
-		return false
+		return ErrTsigAlg
 	}
-	hmac := hmac.NewMD5([]byte(rawsecret))
-	io.WriteString(hmac, string(buf))
-	rr.MAC = string(hmac.Sum())
+	h := hmac.New(newHmac, []byte(rawsecret))
+	io.WriteString(h, string(buf))
+	rr.MAC = string(h.Sum(nil))
 	rr.MACSize = uint16(len(rr.MAC))
 	rr.OrigId = msg.MsgHdr.Id
-	return true
+	return nil
 }
 
 // Verify a TSIG. The msg should be the complete message with
 // the TSIG record still attached (as the last rr in the Additional
-// section) TODO(mg)
+// section). On failure the returned error is a *TsigError, and rr.Error
+// (plus, for BADTIME, rr.OtherData/rr.OtherLen) is populated per RFC
+// 2845 section 4.5 so the caller can send rr straight back to the peer.
 // The secret is a base64 encoded string with a secret
-func (rr *RR_TSIG) Verify(msg *Msg, secret string) bool {
+func (rr *RR_TSIG) Verify(msg *Msg, secret string) error {
 	// copy the mesg, strip (and check) the tsig rr
-	// perform the opposite of Generate() and then 
+	// perform the opposite of Generate() and then
 	// verify the mac
-	rawsecret, err := packBase64([]byte(secret))
-        if err != nil {
-                return false
-        }
+	rawsecret := unpackBase64([]byte(secret))
 
-	msg2 := msg // TODO deep copy TODO(mg)
+	msg2 := msg.copy()
 	if len(msg2.Extra) < 1 {
 		// nothing in additional
-		return false
+		return rr.fail(ErrTsigNoTsig)
 	}
-	tsigrr := msg2.Extra[len(msg2.Extra)-1]
-	if tsigrr.Header().Rrtype != TypeTSIG {
+	tsigrr, ok := msg2.Extra[len(msg2.Extra)-1].(*RR_TSIG)
+	if !ok {
 		// not a tsig RR
-		return false
+		return rr.fail(ErrTsigNoTsig)
+	}
+	if !strings.EqualFold(tsigrr.Header().Name, rr.Header().Name) ||
+		!strings.EqualFold(tsigrr.Algorithm, rr.Algorithm) {
+		return rr.fail(ErrTsigBadKey)
 	}
 	msg2.MsgHdr.Id = rr.OrigId
-	msg2.Extra = msg2.Extra[:len(msg2.Extra)-1]     // Strip off the TSIG
-	// TODO(mg)
-	buf, ok := tsigToBuf(rr, msg2)
+	msg2.Extra = msg2.Extra[:len(msg2.Extra)-1] // Strip off the TSIG
+	buf, err := tsigToBuf(rr, msg2)
+	if err != nil {
+		return rr.fail(ErrTsigFormat)
+	}
+	newHmac, ok := HmacHashes[strings.ToLower(rr.Algorithm)]
 	if !ok {
-		return false
+		return rr.fail(ErrTsigAlg)
 	}
-	h := hmac.NewMD5([]byte(rawsecret))
+	h := hmac.New(newHmac, []byte(rawsecret))
 	io.WriteString(h, string(buf))
-        return string(h.Sum()) == rr.MAC
+	if string(h.Sum(nil)) != rr.MAC {
+		return rr.fail(ErrTsigBadSig)
+	}
+
+	// RFC 2845 section 4.6: the times signed must be within Fudge seconds
+	// of "now", as seen by the verifier.
+	now := uint64(time.Now().Unix())
+	ti := now - rr.TimeSigned
+	if now < rr.TimeSigned {
+		ti = rr.TimeSigned - now
+	}
+	if ti > uint64(rr.Fudge) {
+		return rr.failBadTime(now)
+	}
+	rr.Error = TsigErrorNoError
+	rr.OtherLen = 0
+	rr.OtherData = ""
+	return nil
 }
 
-func tsigToBuf(rr *RR_TSIG, msg *Msg) ([]byte, bool) {
-	// Fill the struct and generate the wiredata
-	buf := make([]byte, 4096) // TODO(mg) bufsize!
+// fail records e's RFC 2845/4635 error code into rr.Error, clears any
+// stale OtherData and returns e, so a caller can both send rr straight
+// back to the peer and propagate the failure.
+func (rr *RR_TSIG) fail(e *TsigError) error {
+	rr.Error = e.Code
+	rr.OtherLen = 0
+	rr.OtherData = ""
+	return e
+}
+
+// failBadTime is fail(ErrTsigBadTime), additionally filling OtherData
+// with the verifier's current time as a 48-bit big endian integer, per
+// RFC 2845 section 4.5.2, so the peer can resynchronize its clock and
+// retry.
+func (rr *RR_TSIG) failBadTime(now uint64) error {
+	rr.Error = ErrTsigBadTime.Code
+	buf := make([]byte, 6)
+	buf[0] = byte(now >> 40)
+	buf[1] = byte(now >> 32)
+	buf[2] = byte(now >> 24)
+	buf[3] = byte(now >> 16)
+	buf[4] = byte(now >> 8)
+	buf[5] = byte(now)
+	rr.OtherData = string(buf)
+	rr.OtherLen = uint16(len(buf))
+	return ErrTsigBadTime
+}
+
+// maxTsigVarsSize bounds how far tsigVarsBuf grows its scratch buffer
+// while looking for one big enough to hold the packed TSIG variables -
+// the 65535 byte ceiling on a TCP/EDNS0 DNS message.
+const maxTsigVarsSize = 65535
+
+// tsigVarsBuf packs the RFC 2845 section 3.4.2 TSIG variables derived
+// from rr into their wire format, for use in computing a MAC. The
+// scratch buffer starts small and doubles until packStruct succeeds,
+// clamping the final attempt to maxTsigVarsSize, so a large Algorithm
+// name or OtherData (as EDNS0 allows) no longer overflows a fixed-size
+// buffer.
+func tsigVarsBuf(rr *RR_TSIG) ([]byte, bool) {
 	tsig := new(tsigWireFmt)
 	tsig.Name = rr.Header().Name
 	tsig.Class = rr.Header().Class
@@ -131,17 +250,364 @@ func tsigToBuf(rr *RR_TSIG, msg *Msg) ([]byte, bool) {
 	tsig.Error = rr.Error
 	tsig.OtherLen = rr.OtherLen
 	tsig.OtherData = rr.OtherData
-	n, ok1 := packStruct(tsig, buf, 0)
-	if !ok1 {
-		return nil, false
+
+	for size := 512; ; size *= 2 {
+		if size > maxTsigVarsSize {
+			size = maxTsigVarsSize
+		}
+		buf := make([]byte, size)
+		if n, ok := packStruct(tsig, buf, 0); ok {
+			return buf[:n], true
+		}
+		if size == maxTsigVarsSize {
+			return nil, false
+		}
+	}
+}
+
+// tsigToBuf packs msg and appends the TSIG variables derived from rr, for
+// feeding to the MAC. msg must already have its Id restored to the
+// original query Id and its TSIG RR (if any) stripped from Extra: Pack
+// derives ARCOUNT from len(msg.Extra), so a stripped Extra already packs
+// with the TSIG correctly excluded from both the digest and the count.
+func tsigToBuf(rr *RR_TSIG, msg *Msg) ([]byte, error) {
+	tsigvars, ok := tsigVarsBuf(rr)
+	if !ok {
+		return nil, ErrTsigFormat
 	}
-	buf = buf[:n]
 	msgbuf, ok := msg.Pack()
 	if !ok {
-		return nil, false
+		return nil, ErrTsigFormat
 	}
         // First the pkg, then the tsig wire fmt
-	buf = append(msgbuf, buf...)
-        fmt.Printf("buf %v\n", buf)
-	return buf, true
+	buf := append(msgbuf, tsigvars...)
+	return buf, nil
+}
+
+// copyRR returns a deep copy of r: RR implementations in this package
+// are pointers to a plain struct, and deepCopyValue additionally copies
+// any slice or map field within that struct (e.g. TXT's string slice),
+// so the result shares no mutable state with r.
+func copyRR(r RR) RR {
+	v := reflect.ValueOf(r)
+	if v.Kind() != reflect.Ptr {
+		return r
+	}
+	cp := reflect.New(v.Elem().Type())
+	deepCopyValue(cp.Elem(), v.Elem())
+	return cp.Interface().(RR)
+}
+
+// deepCopyValue copies src into dst field by field, recursing into any
+// slice, map or pointer so dst ends up sharing no backing storage with
+// src.
+func deepCopyValue(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				deepCopyValue(dst.Field(i), src.Field(i))
+			}
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeSlice(src.Type(), src.Len(), src.Len()))
+		for i := 0; i < src.Len(); i++ {
+			deepCopyValue(dst.Index(i), src.Index(i))
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeMap(src.Type()))
+		for _, k := range src.MapKeys() {
+			v := reflect.New(src.Type().Elem()).Elem()
+			deepCopyValue(v, src.MapIndex(k))
+			dst.SetMapIndex(k, v)
+		}
+	case reflect.Ptr:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.New(src.Elem().Type()))
+		deepCopyValue(dst.Elem(), src.Elem())
+	default:
+		dst.Set(src)
+	}
+}
+
+func copyRRslice(rrs []RR) []RR {
+	if rrs == nil {
+		return nil
+	}
+	cp := make([]RR, len(rrs))
+	for i, r := range rrs {
+		cp[i] = copyRR(r)
+	}
+	return cp
+}
+
+// copy returns a deep copy of m: its Question, Answer, Ns and Extra
+// slices, the RR values behind them, and any slice/map field nested
+// inside those RRs, are all independent of m, so a caller can mutate the
+// result (e.g. to strip a TSIG RR before verifying) without aliasing or
+// corrupting the original message.
+func (m *Msg) copy() *Msg {
+	m2 := new(Msg)
+	*m2 = *m
+	m2.Question = append([]Question(nil), m.Question...)
+	m2.Answer = copyRRslice(m.Answer)
+	m2.Ns = copyRRslice(m.Ns)
+	m2.Extra = copyRRslice(m.Extra)
+	return m2
+}
+
+// TsigContext carries the running HMAC state needed to sign or verify a
+// sequence of related messages, such as an AXFR/IXFR response, per RFC
+// 2845 section 4.4. Only the first, the last and roughly every 100th
+// message in between need actually carry a TSIG RR; every message in
+// the stream, signed or not, is fed into one continuous HMAC that spans
+// the whole segment since the previous signed message, and is only
+// finalized (Sum) when a TSIG RR is due.
+type TsigContext struct {
+	keyname   string
+	algorithm string
+	secret    string // base64 encoded
+	fudge     uint16
+	h         hash.Hash // open HMAC for the segment since the last signed message
+	prevMAC   string
+	count     int
+}
+
+// NewTsigContext returns a TsigContext that signs or verifies a stream
+// of messages using the key keyname, algorithm algo and base64 encoded
+// secret, with the given Fudge applied to every TSIG RR it produces.
+// requestMAC is the MAC of the TSIG RR on the request that triggered
+// this stream (e.g. the AXFR query); RFC 2845 section 4.4 requires the
+// first message's digest to be primed with it, exactly as every later
+// message is primed with the MAC of the one before. Pass "" if the
+// request carried no TSIG.
+func NewTsigContext(keyname, algo, secret string, fudge uint16, requestMAC string) *TsigContext {
+	return &TsigContext{keyname: keyname, algorithm: algo, secret: secret, fudge: fudge, prevMAC: requestMAC}
+}
+
+// tsigStreamNeedsRR reports whether message number count (1-based) in a
+// stream must carry its own TSIG RR: RFC 2845 requires it on the first
+// and last message, and recommends it at least every 100 messages in
+// between.
+func tsigStreamNeedsRR(count int, last bool) bool {
+	return count == 1 || last || count%100 == 0
+}
+
+// openHash returns ctx's open HMAC for the current segment, creating it
+// (keyed with the secret, and primed with the previous MAC as a 2-byte
+// length plus data, per RFC 2845 section 4.4) if a new segment is
+// starting.
+func (ctx *TsigContext) openHash() (hash.Hash, error) {
+	if ctx.h != nil {
+		return ctx.h, nil
+	}
+	newHmac, ok := HmacHashes[strings.ToLower(ctx.algorithm)]
+	if !ok {
+		return nil, ErrTsigAlg
+	}
+	rawsecret := unpackBase64([]byte(ctx.secret))
+	h := hmac.New(newHmac, []byte(rawsecret))
+	if ctx.prevMAC != "" {
+		var lenbuf [2]byte
+		lenbuf[0] = byte(len(ctx.prevMAC) >> 8)
+		lenbuf[1] = byte(len(ctx.prevMAC))
+		h.Write(lenbuf[:])
+		io.WriteString(h, ctx.prevMAC)
+	}
+	ctx.h = h
+	return ctx.h, nil
+}
+
+// tsigTimersBuf packs just the TSIG timers (TimeSigned, Fudge), used to
+// close out the digest of messages after the first in a stream, per
+// RFC 2845 section 4.4 - the full TSIG variables are only used for the
+// very first message (section 4.2).
+func tsigTimersBuf(timeSigned uint64, fudge uint16) []byte {
+	buf := make([]byte, 8)
+	buf[0] = byte(timeSigned >> 40)
+	buf[1] = byte(timeSigned >> 32)
+	buf[2] = byte(timeSigned >> 24)
+	buf[3] = byte(timeSigned >> 16)
+	buf[4] = byte(timeSigned >> 8)
+	buf[5] = byte(timeSigned)
+	buf[6] = byte(fudge >> 8)
+	buf[7] = byte(fudge)
+	return buf
+}
+
+// SignNext signs msg using ctx's running HMAC state and, if required by
+// tsigStreamNeedsRR, attaches a TSIG RR to msg.Extra. Set last to true
+// for the final message in the stream.
+func (ctx *TsigContext) SignNext(msg *Msg, last bool) error {
+	ctx.count++
+	needsRR := tsigStreamNeedsRR(ctx.count, last)
+
+	h, err := ctx.openHash()
+	if err != nil {
+		return err
+	}
+	msgbuf, ok := msg.Pack()
+	if !ok {
+		return ErrTsigFormat
+	}
+	h.Write(msgbuf)
+
+	if !needsRR {
+		return nil
+	}
+
+	rr := new(RR_TSIG)
+	rr.Hdr = RR_Header{Name: ctx.keyname, Rrtype: TypeTSIG, Class: ClassANY, Ttl: 0}
+	rr.Algorithm = ctx.algorithm
+	rr.TimeSigned = uint64(time.Now().Unix())
+	rr.Fudge = ctx.fudge
+	rr.OrigId = msg.MsgHdr.Id
+
+	if ctx.count == 1 {
+		varsbuf, ok := tsigVarsBuf(rr)
+		if !ok {
+			return ErrTsigFormat
+		}
+		h.Write(varsbuf)
+	} else {
+		h.Write(tsigTimersBuf(rr.TimeSigned, rr.Fudge))
+	}
+
+	ctx.prevMAC = string(h.Sum(nil))
+	ctx.h = nil // start a fresh segment after this signed message
+
+	rr.MAC = ctx.prevMAC
+	rr.MACSize = uint16(len(rr.MAC))
+	msg.Extra = append(msg.Extra, rr)
+	return nil
+}
+
+// VerifyNext verifies msg against ctx's running HMAC state. Messages
+// that do not carry a TSIG RR of their own are still fed into the open
+// HMAC so a later signed message can be verified correctly.
+func (ctx *TsigContext) VerifyNext(msg *Msg) error {
+	ctx.count++
+	var rr *RR_TSIG
+	if len(msg.Extra) > 0 {
+		if t, ok := msg.Extra[len(msg.Extra)-1].(*RR_TSIG); ok {
+			rr = t
+		}
+	}
+
+	if rr == nil {
+		if tsigStreamNeedsRR(ctx.count, false) {
+			return ErrTsigNoTsig
+		}
+		h, err := ctx.openHash()
+		if err != nil {
+			return err
+		}
+		msgbuf, ok := msg.Pack()
+		if !ok {
+			return ErrTsigFormat
+		}
+		h.Write(msgbuf)
+		return nil
+	}
+
+	if !strings.EqualFold(rr.Header().Name, ctx.keyname) ||
+		!strings.EqualFold(rr.Algorithm, ctx.algorithm) {
+		return ErrTsigBadKey
+	}
+
+	msg2 := msg.copy()
+	msg2.MsgHdr.Id = rr.OrigId
+	msg2.Extra = msg2.Extra[:len(msg2.Extra)-1]
+
+	h, err := ctx.openHash()
+	if err != nil {
+		return err
+	}
+	msgbuf, ok := msg2.Pack()
+	if !ok {
+		return ErrTsigFormat
+	}
+	h.Write(msgbuf)
+
+	if ctx.count == 1 {
+		varsbuf, ok := tsigVarsBuf(rr)
+		if !ok {
+			return ErrTsigFormat
+		}
+		h.Write(varsbuf)
+	} else {
+		h.Write(tsigTimersBuf(rr.TimeSigned, rr.Fudge))
+	}
+
+	mac := h.Sum(nil)
+	ctx.h = nil // start a fresh segment after this signed message
+
+	if string(mac) != rr.MAC {
+		return ErrTsigBadSig
+	}
+	ctx.prevMAC = rr.MAC
+	return nil
+}
+
+// TsigSecret maps a TSIG key name to its base64 encoded secret. Client
+// and Server (client.go, server.go) each have a TsigSecret field, set
+// together with SetTsig, so callers configure keys once instead of
+// building an RR_TSIG and calling Generate/Verify for every message by
+// hand.
+type TsigSecret map[string]string
+
+// tsigSign builds and appends a TSIG RR to msg for the key keyname,
+// using algo and fudge, with the secret looked up from secrets.
+// Client.Exchange and Server.ListenAndServe call this to sign outgoing
+// messages automatically once SetTsig has been used.
+func tsigSign(msg *Msg, secrets TsigSecret, keyname, algo string, fudge uint16) error {
+	secret, ok := secrets[keyname]
+	if !ok {
+		return ErrTsigBadKey
+	}
+	rr := new(RR_TSIG)
+	rr.Hdr = RR_Header{Name: keyname, Rrtype: TypeTSIG, Class: ClassANY, Ttl: 0}
+	rr.Algorithm = algo
+	rr.TimeSigned = uint64(time.Now().Unix())
+	rr.Fudge = fudge
+	if err := rr.Generate(msg, secret); err != nil {
+		return err
+	}
+	msg.Extra = append(msg.Extra, rr)
+	return nil
+}
+
+// tsigCheck verifies the TSIG RR (if any) already attached to msg
+// against the secret registered for keyname and the algorithm algo.
+// Verify checks the incoming TSIG RR's name and algorithm against the
+// rr it is called on, so rr must carry the expected key identity rather
+// than the incoming RR itself, or the check would trivially match
+// itself. Client.Exchange and Server.ListenAndServe call this to verify
+// incoming messages automatically once SetTsig has been used; a
+// mismatch is surfaced to the caller as an error instead of being
+// silently dropped.
+func tsigCheck(msg *Msg, secrets TsigSecret, keyname, algo string) error {
+	secret, ok := secrets[keyname]
+	if !ok {
+		return ErrTsigBadKey
+	}
+	expected := &RR_TSIG{Hdr: RR_Header{Name: keyname}, Algorithm: algo}
+	if n := len(msg.Extra); n > 0 {
+		if in, ok := msg.Extra[n-1].(*RR_TSIG); ok {
+			// Verify digests and checks the MAC, times and OrigId of the
+			// rr it is called on, so those are taken from the incoming RR.
+			*expected = *in
+			expected.Hdr.Name = keyname
+			expected.Algorithm = algo
+		}
+	}
+	return expected.Verify(msg, secret)
 }
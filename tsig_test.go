@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTsigGenerateVerify checks that Verify accepts a TSIG just produced
+// by Generate, for every registered HMAC algorithm, and rejects it once
+// the secret or the signed message no longer match.
+func TestTsigGenerateVerify(t *testing.T) {
+	const secret = "c2VjcmV0a2V5" // base64 for "secretkey"
+
+	for algo := range HmacHashes {
+		msg := new(Msg)
+		msg.MsgHdr.Id = 1234
+		msg.Question = []Question{{Name: "miek.nl.", Qtype: TypeA, Qclass: ClassINET}}
+
+		rr := &RR_TSIG{
+			Hdr:        RR_Header{Name: "axfr-key.", Rrtype: TypeTSIG, Class: ClassANY},
+			Algorithm:  algo,
+			TimeSigned: uint64(time.Now().Unix()),
+			Fudge:      300,
+		}
+		if err := rr.Generate(msg, secret); err != nil {
+			t.Fatalf("%s: Generate: %v", algo, err)
+		}
+		msg.Extra = append(msg.Extra, rr)
+
+		if err := rr.Verify(msg, secret); err != nil {
+			t.Errorf("%s: Verify of a freshly generated TSIG failed: %v", algo, err)
+		}
+
+		if err := rr.Verify(msg, "d3JvbmdrZXk="); err == nil {
+			t.Errorf("%s: Verify accepted the wrong secret", algo)
+		}
+
+		saved := msg.Question[0].Name
+		msg.Question[0].Name = "tampered."
+		if err := rr.Verify(msg, secret); err == nil {
+			t.Errorf("%s: Verify accepted a tampered message", algo)
+		}
+		msg.Question[0].Name = saved
+	}
+}
+
+// TestTsigContextStream checks that a SignNext/VerifyNext pair can sign
+// and verify a multi-message AXFR-style stream, including the first
+// message carrying a primed requestMAC.
+func TestTsigContextStream(t *testing.T) {
+	const secret = "c2VjcmV0a2V5"
+	requestMAC := "request-mac-bytes"
+
+	sctx := NewTsigContext("axfr-key.", HmacSHA256, secret, 300, requestMAC)
+	vctx := NewTsigContext("axfr-key.", HmacSHA256, secret, 300, requestMAC)
+
+	last := []bool{false, false, true}
+	for i, isLast := range last {
+		msg := new(Msg)
+		msg.MsgHdr.Id = 42
+		msg.Question = []Question{{Name: "axfr.example.", Qtype: TypeAXFR, Qclass: ClassINET}}
+
+		if err := sctx.SignNext(msg, isLast); err != nil {
+			t.Fatalf("envelope %d: SignNext: %v", i, err)
+		}
+		if err := vctx.VerifyNext(msg); err != nil {
+			t.Fatalf("envelope %d: VerifyNext: %v", i, err)
+		}
+	}
+}
+
+// TestMsgCopyIndependence checks that Msg.copy() deep copies RRs, so
+// mutating the copy's Extra does not reach back into the original
+// message.
+func TestMsgCopyIndependence(t *testing.T) {
+	msg := new(Msg)
+	msg.Extra = []RR{&RR_TSIG{Algorithm: HmacSHA256}}
+
+	cp := msg.copy()
+	cp.Extra[0].(*RR_TSIG).Algorithm = "changed"
+
+	if msg.Extra[0].(*RR_TSIG).Algorithm == "changed" {
+		t.Fatal("Msg.copy() aliased the original RR instead of deep copying it")
+	}
+}